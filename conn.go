@@ -0,0 +1,231 @@
+package shapeio
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// Conn wraps a net.Conn and applies independent rate limits to reads and
+// writes.
+type Conn struct {
+	c            net.Conn
+	ctx          context.Context
+	readLimiter  *rate.Limiter
+	writeLimiter *rate.Limiter
+
+	readDeadlineNano  int64 // atomic, unix nanoseconds; 0 means no deadline
+	writeDeadlineNano int64 // atomic, unix nanoseconds; 0 means no deadline
+}
+
+// NewConn returns a net.Conn with rate limiting.
+func NewConn(c net.Conn) *Conn {
+	return &Conn{
+		c:   c,
+		ctx: context.Background(),
+	}
+}
+
+// NewConnWithContext returns a net.Conn with rate limiting.
+func NewConnWithContext(c net.Conn, ctx context.Context) *Conn {
+	return &Conn{
+		c:   c,
+		ctx: ctx,
+	}
+}
+
+// SetReadRateLimit sets the read rate limit (bytes/sec) on the connection,
+// using the rate itself as the burst size.
+func (s *Conn) SetReadRateLimit(bytesPerSec float64) {
+	s.SetReadRateLimitWithBurst(bytesPerSec, bytesPerSec)
+}
+
+// SetReadRateLimitWithBurst sets a read rate limit (bytes/sec) and a
+// distinct burst size (bytes) on the connection.
+func (s *Conn) SetReadRateLimitWithBurst(bytesPerSec, burst float64) {
+	s.readLimiter = rate.NewLimiter(rate.Limit(bytesPerSec), int(burst))
+}
+
+// SetWriteRateLimit sets the write rate limit (bytes/sec) on the
+// connection, using the rate itself as the burst size.
+func (s *Conn) SetWriteRateLimit(bytesPerSec float64) {
+	s.SetWriteRateLimitWithBurst(bytesPerSec, bytesPerSec)
+}
+
+// SetWriteRateLimitWithBurst sets a write rate limit (bytes/sec) and a
+// distinct burst size (bytes) on the connection.
+func (s *Conn) SetWriteRateLimitWithBurst(bytesPerSec, burst float64) {
+	s.writeLimiter = rate.NewLimiter(rate.Limit(bytesPerSec), int(burst))
+}
+
+// ReadLimiter returns the limiter backing reads, or nil if no read rate
+// limit has been set. Pass the returned limiter to SetReadLimiter on other
+// Conns to share a single throughput cap across connections.
+func (s *Conn) ReadLimiter() *rate.Limiter {
+	return s.readLimiter
+}
+
+// WriteLimiter returns the limiter backing writes, or nil if no write rate
+// limit has been set.
+func (s *Conn) WriteLimiter() *rate.Limiter {
+	return s.writeLimiter
+}
+
+// SetReadLimiter sets the limiter backing reads directly, allowing several
+// Conns to share one token bucket and enforce an aggregate read throughput
+// cap.
+func (s *Conn) SetReadLimiter(l *rate.Limiter) {
+	s.readLimiter = l
+}
+
+// SetWriteLimiter sets the limiter backing writes directly, allowing several
+// Conns to share one token bucket and enforce an aggregate write throughput
+// cap.
+func (s *Conn) SetWriteLimiter(l *rate.Limiter) {
+	s.writeLimiter = l
+}
+
+// Read reads bytes into p, honoring the read rate limit if one is set.
+func (s *Conn) Read(p []byte) (int, error) {
+	if s.readLimiter == nil {
+		return s.c.Read(p)
+	}
+
+	for i := 0; i < len(p); {
+		rem := len(p) - i
+		chunk := s.readLimiter.Burst()
+		if chunk > rem {
+			chunk = rem
+		}
+
+		n, err := s.c.Read(p[i : i+chunk])
+		if n > 0 {
+			ctx, cancel := s.boundedCtx(&s.readDeadlineNano)
+			werr := waitN(ctx, s.readLimiter, n)
+			cancel()
+			if werr != nil {
+				return i + n, s.wrapWaitErr(werr)
+			}
+		}
+		i += n
+		if err != nil {
+			return i, err
+		}
+	}
+	return len(p), nil
+}
+
+// Write writes bytes from p, honoring the write rate limit if one is set.
+func (s *Conn) Write(p []byte) (int, error) {
+	if s.writeLimiter == nil {
+		return s.c.Write(p)
+	}
+
+	for i := 0; i < len(p); {
+		rem := len(p) - i
+		chunk := s.writeLimiter.Burst()
+		if chunk > rem {
+			chunk = rem
+		}
+
+		n, err := s.c.Write(p[i : i+chunk])
+		if n > 0 {
+			ctx, cancel := s.boundedCtx(&s.writeDeadlineNano)
+			werr := waitN(ctx, s.writeLimiter, n)
+			cancel()
+			if werr != nil {
+				return i + n, s.wrapWaitErr(werr)
+			}
+		}
+		i += n
+		if err != nil {
+			return i, err
+		}
+	}
+	return len(p), nil
+}
+
+// boundedCtx derives a context from s.ctx that additionally expires at the
+// deadline currently stored in deadlineNano, so that a SetReadDeadline or
+// SetWriteDeadline call bounds how long the rate limiter itself may block
+// Read/Write, not just the underlying socket I/O. deadlineNano is read
+// fresh on every call so a deadline set while a Read/Write is in flight
+// still takes effect on its next iteration.
+func (s *Conn) boundedCtx(deadlineNano *int64) (context.Context, context.CancelFunc) {
+	nano := atomic.LoadInt64(deadlineNano)
+	if nano == 0 {
+		return s.ctx, func() {}
+	}
+	return context.WithDeadline(s.ctx, time.Unix(0, nano))
+}
+
+// wrapWaitErr turns a context error from the limiter into a net.Error whose
+// Timeout method reports true when the connection's context deadline has
+// elapsed, matching the behavior callers expect from net.Conn.
+func (s *Conn) wrapWaitErr(err error) error {
+	if err == context.DeadlineExceeded {
+		return &timeoutError{err}
+	}
+	return err
+}
+
+// timeoutError adapts an error into a net.Error reporting Timeout() == true.
+type timeoutError struct {
+	error
+}
+
+func (e *timeoutError) Timeout() bool   { return true }
+func (e *timeoutError) Temporary() bool { return true }
+
+// Close closes the connection.
+func (s *Conn) Close() error {
+	return s.c.Close()
+}
+
+// LocalAddr returns the local network address, if known.
+func (s *Conn) LocalAddr() net.Addr {
+	return s.c.LocalAddr()
+}
+
+// RemoteAddr returns the remote network address, if known.
+func (s *Conn) RemoteAddr() net.Addr {
+	return s.c.RemoteAddr()
+}
+
+// SetDeadline sets the read and write deadlines on the underlying
+// connection, and also bounds how long the rate limiter may block Read and
+// Write once it is asked to wait.
+func (s *Conn) SetDeadline(t time.Time) error {
+	storeDeadline(&s.readDeadlineNano, t)
+	storeDeadline(&s.writeDeadlineNano, t)
+	return s.c.SetDeadline(t)
+}
+
+// SetReadDeadline sets the read deadline on the underlying connection, and
+// also bounds how long the rate limiter may block Read once it is asked to
+// wait.
+func (s *Conn) SetReadDeadline(t time.Time) error {
+	storeDeadline(&s.readDeadlineNano, t)
+	return s.c.SetReadDeadline(t)
+}
+
+// SetWriteDeadline sets the write deadline on the underlying connection,
+// and also bounds how long the rate limiter may block Write once it is
+// asked to wait.
+func (s *Conn) SetWriteDeadline(t time.Time) error {
+	storeDeadline(&s.writeDeadlineNano, t)
+	return s.c.SetWriteDeadline(t)
+}
+
+// storeDeadline atomically stores t's unix nanoseconds into *dst, or 0 if
+// t is the zero time (no deadline).
+func storeDeadline(dst *int64, t time.Time) {
+	var nano int64
+	if !t.IsZero() {
+		nano = t.UnixNano()
+	}
+	atomic.StoreInt64(dst, nano)
+}
@@ -0,0 +1,36 @@
+package shapeio
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestConnReadDeadlineBoundsLimiterWait(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	go server.Write([]byte{1, 2})
+
+	c := NewConn(client)
+	c.SetReadRateLimit(1) // 1 byte/sec, burst 1: the second byte must wait ~1s for a token
+
+	c.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+
+	start := time.Now()
+	var p [2]byte
+	_, err := c.Read(p[:])
+	elapsed := time.Since(start)
+
+	if err == nil {
+		t.Fatalf("Read succeeded, want a timeout error once the read deadline elapsed")
+	}
+	ne, ok := err.(net.Error)
+	if !ok || !ne.Timeout() {
+		t.Fatalf("Read error = %v (%T), want a net.Error with Timeout() == true", err, err)
+	}
+	if elapsed > 500*time.Millisecond {
+		t.Fatalf("Read took %v, want well under the ~1s token-bucket wait since SetReadDeadline should cut it short", elapsed)
+	}
+}
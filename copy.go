@@ -0,0 +1,92 @@
+package shapeio
+
+import (
+	"context"
+	"io"
+	"time"
+)
+
+// progressInterval and progressBytes bound how often Copy/CopyN call their
+// progress callback: whichever threshold is hit first triggers a report.
+const (
+	progressInterval = 100 * time.Millisecond
+	progressBytes    = 1 << 20 // 1 MiB
+)
+
+// Copy copies from src to dst at the given rate limit (bytes/sec; 0 means
+// unlimited), calling progress periodically with the cumulative number of
+// bytes copied so far and the current instantaneous rate (bytes/sec,
+// see Stats.CurrentRate). It returns as soon as ctx is canceled, with
+// ctx.Err(), even if the copy has not finished.
+func Copy(ctx context.Context, dst io.Writer, src io.Reader, bytesPerSec float64, progress func(n int64, rate float64)) (int64, error) {
+	return copyBuffer(ctx, dst, src, -1, bytesPerSec, progress)
+}
+
+// CopyN copies n bytes (or until src runs out or errors) from src to dst
+// at the given rate limit (bytes/sec; 0 means unlimited), calling progress
+// periodically with the cumulative number of bytes copied so far and the
+// current instantaneous rate (bytes/sec, see Stats.CurrentRate). It
+// returns as soon as ctx is canceled, with ctx.Err(), even if the copy has
+// not finished.
+func CopyN(ctx context.Context, dst io.Writer, src io.Reader, n int64, bytesPerSec float64, progress func(n int64, rate float64)) (int64, error) {
+	return copyBuffer(ctx, dst, src, n, bytesPerSec, progress)
+}
+
+func copyBuffer(ctx context.Context, dst io.Writer, src io.Reader, n int64, bytesPerSec float64, progress func(n int64, rate float64)) (int64, error) {
+	if n == 0 {
+		return 0, nil
+	}
+
+	r := NewReaderWithContext(src, ctx)
+	if bytesPerSec > 0 {
+		r.SetRateLimit(bytesPerSec)
+	}
+	if n > 0 {
+		r.SetCap(n)
+	}
+
+	buf := make([]byte, 32*1024)
+	var written, reported int64
+	lastReport := time.Now()
+
+	report := func() {
+		if progress == nil {
+			return
+		}
+		progress(written, r.Stats().CurrentRate)
+		reported = written
+		lastReport = time.Now()
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return written, ctx.Err()
+		default:
+		}
+
+		nr, rerr := r.Read(buf)
+		if nr > 0 {
+			nw, werr := dst.Write(buf[:nr])
+			if nw > 0 {
+				written += int64(nw)
+			}
+			if werr != nil {
+				return written, werr
+			}
+			if nw != nr {
+				return written, io.ErrShortWrite
+			}
+			if written-reported >= progressBytes || time.Since(lastReport) >= progressInterval {
+				report()
+			}
+		}
+		if rerr != nil {
+			if rerr == io.EOF || rerr == ErrLimitReached {
+				rerr = nil
+			}
+			report()
+			return written, rerr
+		}
+	}
+}
@@ -0,0 +1,21 @@
+package shapeio
+
+import (
+	"bytes"
+	"context"
+	"testing"
+)
+
+func TestCopyNZeroCopiesNothing(t *testing.T) {
+	var dst bytes.Buffer
+	n, err := CopyN(context.Background(), &dst, bytes.NewReader(make([]byte, 1000)), 0, 0, nil)
+	if err != nil {
+		t.Fatalf("CopyN: %v", err)
+	}
+	if n != 0 {
+		t.Fatalf("copied %d bytes, want 0", n)
+	}
+	if dst.Len() != 0 {
+		t.Fatalf("dst has %d bytes, want 0", dst.Len())
+	}
+}
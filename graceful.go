@@ -0,0 +1,117 @@
+package shapeio
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrRateExceeded is returned by a graceful-mode Reader/Writer once the
+// peer has exhausted its sliding-window budget.
+var ErrRateExceeded = errors.New("shapeio: sliding-window rate exceeded")
+
+// GracefulLimiter enforces a byte budget over a sliding window rather than
+// a hard per-byte rate cap. Traffic is allowed to burst freely until
+// graceInitial has elapsed since the limiter was created; after that, once
+// the bytes counted in the current window have reached bytesPerWindow,
+// every further call returns ErrRateExceeded instead of blocking. The call
+// that crosses the budget is itself let through in full. This suits
+// untrusted peers you'd rather drop than slow down indefinitely.
+//
+// The window is tracked as a weighted overlap of the current and previous
+// fixed-size windows (the same approximation used by e.g. nginx's sliding
+// window rate limiter), rather than a hard reset every window, so a peer
+// can't double their budget by timing bursts across a window boundary.
+type GracefulLimiter struct {
+	bytesPerWindow int64
+	window         time.Duration
+	graceUntil     time.Time
+
+	mu        sync.Mutex
+	curStart  time.Time
+	curBytes  int64
+	prevBytes int64
+}
+
+// NewGracefulLimiter returns a GracefulLimiter budgeting bytesPerWindow
+// bytes per window, after an initial graceInitial grace period during
+// which traffic is not limited. Share the returned limiter across several
+// Readers/Writers, e.g. all connections from the same peer, to enforce one
+// aggregate budget.
+func NewGracefulLimiter(bytesPerWindow int, window, graceInitial time.Duration) *GracefulLimiter {
+	now := time.Now()
+	return &GracefulLimiter{
+		bytesPerWindow: int64(bytesPerWindow),
+		window:         window,
+		graceUntil:     now.Add(graceInitial),
+		curStart:       now,
+	}
+}
+
+// check reports ErrRateExceeded if the current window's budget has already
+// been exhausted.
+func (gl *GracefulLimiter) check() error {
+	gl.mu.Lock()
+	defer gl.mu.Unlock()
+
+	now := time.Now()
+	if now.Before(gl.graceUntil) {
+		return nil
+	}
+	gl.rotate(now)
+	if gl.weightedUsage(now) >= float64(gl.bytesPerWindow) {
+		return ErrRateExceeded
+	}
+	return nil
+}
+
+// record adds n bytes to the current window's usage.
+func (gl *GracefulLimiter) record(n int) {
+	if n <= 0 {
+		return
+	}
+
+	gl.mu.Lock()
+	defer gl.mu.Unlock()
+
+	now := time.Now()
+	if now.Before(gl.graceUntil) {
+		return
+	}
+	gl.rotate(now)
+	gl.curBytes += int64(n)
+}
+
+// rotate advances curStart/curBytes/prevBytes to the fixed window that now
+// falls in, carrying the previous window's count forward so weightedUsage
+// can blend the two. It must be called with mu held.
+func (gl *GracefulLimiter) rotate(now time.Time) {
+	elapsed := now.Sub(gl.curStart)
+	if elapsed < gl.window {
+		return
+	}
+
+	windows := int64(elapsed / gl.window)
+	if windows == 1 {
+		gl.prevBytes = gl.curBytes
+	} else {
+		// More than one window passed with no activity: there is nothing
+		// to carry forward.
+		gl.prevBytes = 0
+	}
+	gl.curBytes = 0
+	gl.curStart = gl.curStart.Add(time.Duration(windows) * gl.window)
+}
+
+// weightedUsage estimates bytes used in the trailing window ending at now,
+// as the current window's count plus the fraction of the previous window
+// that still overlaps the trailing window. It must be called with mu held,
+// after rotate.
+func (gl *GracefulLimiter) weightedUsage(now time.Time) float64 {
+	elapsedInCur := now.Sub(gl.curStart)
+	weight := 1 - float64(elapsedInCur)/float64(gl.window)
+	if weight < 0 {
+		weight = 0
+	}
+	return float64(gl.prevBytes)*weight + float64(gl.curBytes)
+}
@@ -0,0 +1,40 @@
+package shapeio
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestGracefulLimiterBurstsThenExceedsRate(t *testing.T) {
+	gl := NewGracefulLimiter(100, 10*time.Second, 30*time.Millisecond)
+	r := NewReaderWithGraceful(bytes.NewReader(make([]byte, 10000)), gl)
+
+	// Within the grace period, reads are unmetered: a single read far over
+	// the 100-byte budget must still succeed.
+	buf := make([]byte, 500)
+	n, err := r.Read(buf)
+	if err != nil {
+		t.Fatalf("Read during grace period: %v", err)
+	}
+	if n != len(buf) {
+		t.Fatalf("read %d bytes during grace period, want %d", n, len(buf))
+	}
+
+	time.Sleep(40 * time.Millisecond) // past graceInitial
+
+	// The grace-period reads above were never counted toward the window, so
+	// the budget starts fresh. This read exceeds it in one shot.
+	n, err = r.Read(buf[:150])
+	if err != nil {
+		t.Fatalf("first post-grace Read: %v", err)
+	}
+	if n != 150 {
+		t.Fatalf("read %d bytes, want 150", n)
+	}
+
+	// The window budget is now exhausted, so the next Read must be refused.
+	if _, err := r.Read(buf[:10]); err != ErrRateExceeded {
+		t.Fatalf("Read after exhausting the window = %v, want ErrRateExceeded", err)
+	}
+}
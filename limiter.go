@@ -0,0 +1,111 @@
+package shapeio
+
+import (
+	"io"
+	"net/http"
+
+	"golang.org/x/time/rate"
+)
+
+// Limits configures upload and download throughput caps in bytes/sec. A
+// zero value means unlimited for that direction.
+type Limits struct {
+	UploadBytesPerSec   int
+	DownloadBytesPerSec int
+}
+
+// Limiter enforces a shared upload/download throughput cap across any
+// number of readers, writers, and HTTP round trips it produces. Every
+// stream wrapped by the same Limiter shares one token bucket per
+// direction, so the aggregate throughput across all of them never exceeds
+// the configured Limits.
+type Limiter struct {
+	upload   *rate.Limiter
+	download *rate.Limiter
+}
+
+// NewLimiter returns a Limiter enforcing the given upload/download caps.
+func NewLimiter(limits Limits) *Limiter {
+	l := &Limiter{}
+	if limits.UploadBytesPerSec > 0 {
+		l.upload = rate.NewLimiter(rate.Limit(limits.UploadBytesPerSec), limits.UploadBytesPerSec)
+	}
+	if limits.DownloadBytesPerSec > 0 {
+		l.download = rate.NewLimiter(rate.Limit(limits.DownloadBytesPerSec), limits.DownloadBytesPerSec)
+	}
+	return l
+}
+
+// Upstream wraps r so reads from it are capped by the shared upload limit.
+func (l *Limiter) Upstream(r io.Reader) io.Reader {
+	if l.upload == nil {
+		return r
+	}
+	return NewReaderWithLimiter(r, l.upload)
+}
+
+// UpstreamWriter wraps w so writes to it are capped by the shared upload
+// limit.
+func (l *Limiter) UpstreamWriter(w io.Writer) io.Writer {
+	if l.upload == nil {
+		return w
+	}
+	return NewWriterWithLimiter(w, l.upload)
+}
+
+// Downstream wraps r so reads from it are capped by the shared download
+// limit.
+func (l *Limiter) Downstream(r io.Reader) io.Reader {
+	if l.download == nil {
+		return r
+	}
+	return NewReaderWithLimiter(r, l.download)
+}
+
+// DownstreamWriter wraps w so writes to it are capped by the shared
+// download limit.
+func (l *Limiter) DownstreamWriter(w io.Writer) io.Writer {
+	if l.download == nil {
+		return w
+	}
+	return NewWriterWithLimiter(w, l.download)
+}
+
+// RoundTripper wraps next so that request bodies are rate limited by the
+// upload cap and response bodies by the download cap. If next is nil,
+// http.DefaultTransport is used.
+func (l *Limiter) RoundTripper(next http.RoundTripper) http.RoundTripper {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return &limitedRoundTripper{next: next, limiter: l}
+}
+
+type limitedRoundTripper struct {
+	next    http.RoundTripper
+	limiter *Limiter
+}
+
+func (t *limitedRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		req = req.Clone(req.Context())
+		req.Body = &readCloser{Reader: t.limiter.Upstream(req.Body), Closer: req.Body}
+	}
+
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		return resp, err
+	}
+
+	if resp.Body != nil {
+		resp.Body = &readCloser{Reader: t.limiter.Downstream(resp.Body), Closer: resp.Body}
+	}
+	return resp, nil
+}
+
+// readCloser pairs a rate-limited io.Reader with the io.Closer of the
+// stream it was wrapped around.
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
@@ -2,26 +2,28 @@ package shapeio
 
 import (
 	"context"
+	"fmt"
 	"io"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/time/rate"
 )
 
 type Reader struct {
-	r       io.ReadCloser
-	limiter *rate.Limiter
-	ctx     context.Context
-	limit   int
-	firstOp bool
+	r        io.ReadCloser
+	limiter  *rate.Limiter
+	ctx      context.Context
+	stats    flowStats
+	graceful *GracefulLimiter
 }
 
 type Writer struct {
-	w       io.Writer
-	limiter *rate.Limiter
-	ctx     context.Context
-	limit   int
-	firstOp bool
+	w        io.Writer
+	limiter  *rate.Limiter
+	ctx      context.Context
+	stats    flowStats
+	graceful *GracefulLimiter
 }
 
 // NewReader returns a reader that implements io.Reader with rate limiting.
@@ -72,39 +74,139 @@ func NewWriterWithContext(w io.Writer, ctx context.Context) *Writer {
 	}
 }
 
-// SetRateLimit sets rate limit (bytes/sec) to the reader.
+// NewReaderWithLimiter returns a reader that implements io.Reader, sharing
+// rate limiting with the given limiter. Use this to enforce an aggregate
+// rate limit across several readers by passing them all the same limiter.
+func NewReaderWithLimiter(r io.Reader, l *rate.Limiter) *Reader {
+	return &Reader{
+		r:       io.NopCloser(r),
+		ctx:     context.Background(),
+		limiter: l,
+	}
+}
+
+// NewWriterWithLimiter returns a writer that implements io.Writer, sharing
+// rate limiting with the given limiter. Use this to enforce an aggregate
+// rate limit across several writers by passing them all the same limiter.
+func NewWriterWithLimiter(w io.Writer, l *rate.Limiter) *Writer {
+	return &Writer{
+		w:       w,
+		ctx:     context.Background(),
+		limiter: l,
+	}
+}
+
+// NewReaderWithGraceful returns a reader enforcing the given
+// GracefulLimiter's sliding-window budget instead of a hard per-byte rate
+// cap. Share one GracefulLimiter across several readers, e.g. all
+// connections from the same peer, to enforce one aggregate budget.
+func NewReaderWithGraceful(r io.Reader, gl *GracefulLimiter) *Reader {
+	return &Reader{
+		r:        io.NopCloser(r),
+		ctx:      context.Background(),
+		graceful: gl,
+	}
+}
+
+// NewWriterWithGraceful returns a writer enforcing the given
+// GracefulLimiter's sliding-window budget instead of a hard per-byte rate
+// cap. Share one GracefulLimiter across several writers, e.g. all
+// connections from the same peer, to enforce one aggregate budget.
+func NewWriterWithGraceful(w io.Writer, gl *GracefulLimiter) *Writer {
+	return &Writer{
+		w:        w,
+		ctx:      context.Background(),
+		graceful: gl,
+	}
+}
+
+// SetLimiter sets the limiter backing the reader directly, allowing several
+// readers to share one token bucket and enforce an aggregate rate limit.
+func (s *Reader) SetLimiter(l *rate.Limiter) {
+	s.limiter = l
+}
+
+// SetRateLimit sets rate limit (bytes/sec) to the reader, using the rate
+// itself as the burst size.
 func (s *Reader) SetRateLimit(bytesPerSec float64) {
-	s.limit = int(bytesPerSec)
-	s.limiter = rate.NewLimiter(rate.Limit(bytesPerSec), s.limit)
-	s.firstOp = true
+	s.SetRateLimitWithBurst(bytesPerSec, bytesPerSec)
+}
+
+// SetRateLimitWithBurst sets a rate limit (bytes/sec) and a distinct burst
+// size (bytes) to the reader. The burst is the largest chunk the limiter
+// lets through without waiting, so a burst smaller than bytesPerSec makes
+// the reader smooth out traffic sooner, while a larger burst tolerates
+// short spikes above the steady-state rate.
+func (s *Reader) SetRateLimitWithBurst(bytesPerSec, burst float64) {
+	s.limiter = rate.NewLimiter(rate.Limit(bytesPerSec), int(burst))
+}
+
+// SetCap sets a limit on the total number of bytes the reader will ever
+// pass through. Once n bytes have been read, subsequent Read calls return
+// ErrLimitReached. A cap of 0 means unlimited.
+func (s *Reader) SetCap(n int64) {
+	s.stats.setCap(n)
+}
+
+// Stats returns a snapshot of the reader's transfer activity. It is safe
+// to call concurrently with Read.
+func (s *Reader) Stats() Stats {
+	return s.stats.snapshot()
 }
 
 // Read reads bytes into p.
 func (s *Reader) Read(p []byte) (int, error) {
-	if s.limiter == nil {
-		return s.r.Read(p)
+	if s.graceful != nil {
+		if err := s.graceful.check(); err != nil {
+			return 0, err
+		}
+		n, err := s.read(p)
+		s.graceful.record(n)
+		return n, err
 	}
+	return s.read(p)
+}
 
-	if s.firstOp {
-		s.firstOp = false
-		s.limiter.AllowN(time.Now(), s.limit) // spend initial burst
+func (s *Reader) read(p []byte) (int, error) {
+	if s.limiter == nil && atomic.LoadInt64(&s.stats.cap) <= 0 {
+		n, err := s.r.Read(p)
+		s.stats.add(n)
+		return n, err
 	}
 
 	for i := 0; i < len(p); {
 		rem := len(p) - i
-		limit := s.limit
-		if limit > rem {
-			limit = rem
+		chunk := rem
+		if s.limiter != nil {
+			if b := s.limiter.Burst(); b < chunk {
+				chunk = b
+			}
 		}
 
-		n, err := s.r.Read(p[i : i+limit])
+		chunk, err := s.stats.reserve(chunk)
 		if err != nil {
-			return i + n, err
+			if i > 0 {
+				return i, nil
+			}
+			return i, err
+		}
+		if chunk == 0 {
+			return i, nil
+		}
+
+		n, rerr := s.r.Read(p[i : i+chunk])
+		if n > 0 {
+			s.stats.add(n)
+			if s.limiter != nil {
+				if werr := waitN(s.ctx, s.limiter, n); werr != nil {
+					return i + n, werr
+				}
+			}
 		}
-		if err := s.limiter.WaitN(s.ctx, n); err != nil {
-			return i + n, err
+		i += n
+		if rerr != nil {
+			return i, rerr
 		}
-		i += limit
 	}
 	return len(p), nil
 }
@@ -114,39 +216,120 @@ func (s *Reader) Close() error {
 	return s.r.Close()
 }
 
-// SetRateLimit sets rate limit (bytes/sec) to the writer.
+// SetLimiter sets the limiter backing the writer directly, allowing several
+// writers to share one token bucket and enforce an aggregate rate limit.
+func (s *Writer) SetLimiter(l *rate.Limiter) {
+	s.limiter = l
+}
+
+// SetRateLimit sets rate limit (bytes/sec) to the writer, using the rate
+// itself as the burst size.
 func (s *Writer) SetRateLimit(bytesPerSec float64) {
-	s.limit = int(bytesPerSec)
-	s.limiter = rate.NewLimiter(rate.Limit(bytesPerSec), s.limit)
-	s.firstOp = true
+	s.SetRateLimitWithBurst(bytesPerSec, bytesPerSec)
+}
+
+// SetRateLimitWithBurst sets a rate limit (bytes/sec) and a distinct burst
+// size (bytes) to the writer. The burst is the largest chunk the limiter
+// lets through without waiting, so a burst smaller than bytesPerSec makes
+// the writer smooth out traffic sooner, while a larger burst tolerates
+// short spikes above the steady-state rate.
+func (s *Writer) SetRateLimitWithBurst(bytesPerSec, burst float64) {
+	s.limiter = rate.NewLimiter(rate.Limit(bytesPerSec), int(burst))
+}
+
+// SetCap sets a limit on the total number of bytes the writer will ever
+// pass through. Once n bytes have been written, subsequent Write calls
+// return ErrLimitReached. A cap of 0 means unlimited.
+func (s *Writer) SetCap(n int64) {
+	s.stats.setCap(n)
+}
+
+// Stats returns a snapshot of the writer's transfer activity. It is safe
+// to call concurrently with Write.
+func (s *Writer) Stats() Stats {
+	return s.stats.snapshot()
 }
 
 // Write writes bytes from p.
 func (s *Writer) Write(p []byte) (int, error) {
-	if s.limiter == nil {
-		return s.w.Write(p)
+	if s.graceful != nil {
+		if err := s.graceful.check(); err != nil {
+			return 0, err
+		}
+		n, err := s.write(p)
+		s.graceful.record(n)
+		return n, err
 	}
+	return s.write(p)
+}
 
-	if s.firstOp {
-		s.firstOp = false
-		s.limiter.AllowN(time.Now(), s.limit) // spend initial burst
+func (s *Writer) write(p []byte) (int, error) {
+	if s.limiter == nil && atomic.LoadInt64(&s.stats.cap) <= 0 {
+		n, err := s.w.Write(p)
+		s.stats.add(n)
+		return n, err
 	}
 
 	for i := 0; i < len(p); {
 		rem := len(p) - i
-		limit := s.limit
-		if limit > rem {
-			limit = rem
+		chunk := rem
+		if s.limiter != nil {
+			if b := s.limiter.Burst(); b < chunk {
+				chunk = b
+			}
 		}
 
-		n, err := s.w.Write(p[i : i+limit])
+		chunk, err := s.stats.reserve(chunk)
 		if err != nil {
-			return i + n, err
+			if i > 0 {
+				return i, nil
+			}
+			return i, err
+		}
+		if chunk == 0 {
+			return i, nil
 		}
-		if err := s.limiter.WaitN(s.ctx, n); err != nil {
-			return i + n, err
+
+		n, werr := s.w.Write(p[i : i+chunk])
+		if n > 0 {
+			s.stats.add(n)
+			if s.limiter != nil {
+				if err := waitN(s.ctx, s.limiter, n); err != nil {
+					return i + n, err
+				}
+			}
+		}
+		i += n
+		if werr != nil {
+			return i, werr
 		}
-		i += limit
 	}
 	return len(p), nil
 }
+
+// waitN reserves n tokens for the bytes actually transferred and waits out
+// any resulting delay. Reserving after the fact, rather than spending a
+// whole burst upfront, means an op that fits within the current burst
+// returns immediately; only once the burst is exhausted does a later op
+// pay the accumulated delay.
+func waitN(ctx context.Context, limiter *rate.Limiter, n int) error {
+	rsv := limiter.ReserveN(time.Now(), n)
+	if !rsv.OK() {
+		return fmt.Errorf("shapeio: read/write of %d bytes exceeds limiter burst %d", n, limiter.Burst())
+	}
+
+	delay := rsv.Delay()
+	if delay <= 0 {
+		return nil
+	}
+
+	t := time.NewTimer(delay)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		rsv.Cancel()
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,106 @@
+package shapeio
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestReaderSmallReadReturnsImmediately(t *testing.T) {
+	r := NewReader(bytes.NewReader(make([]byte, 1<<20)))
+	r.SetRateLimit(1 << 20) // 1 MiB/s
+
+	start := time.Now()
+	var p [1]byte
+	if _, err := r.Read(p[:]); err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Millisecond {
+		t.Fatalf("Read(p[:1]) on a fresh 1 MiB/s reader took %v, want < 10ms", elapsed)
+	}
+}
+
+// steadyStateWant returns how long transferring size bytes through a
+// limiter configured with SetRateLimitWithBurst(rate, burst) should take:
+// the burst passes through immediately, and everything after it is metered
+// at rate bytes/sec.
+func steadyStateWant(size, rate, burst int) time.Duration {
+	return time.Duration(float64(size-burst) / float64(rate) * float64(time.Second))
+}
+
+func assertWithinTolerance(t *testing.T, elapsed, want time.Duration) {
+	t.Helper()
+	tolerance := want / 20 // ±5%
+	if elapsed < want-tolerance || elapsed > want+tolerance {
+		t.Fatalf("took %v, want within 5%% of %v", elapsed, want)
+	}
+}
+
+func TestReaderSteadyStateRateAccuracy(t *testing.T) {
+	const (
+		rate  = 200 * 1000 // 200,000 bytes/sec
+		burst = 2000       // small burst so most of the transfer is metered
+		size  = burst + rate/2
+	)
+
+	r := NewReader(bytes.NewReader(make([]byte, size)))
+	r.SetRateLimitWithBurst(rate, burst)
+
+	start := time.Now()
+	n, err := io.Copy(io.Discard, r)
+	elapsed := time.Since(start)
+	if err != nil {
+		t.Fatalf("Copy: %v", err)
+	}
+	if n != size {
+		t.Fatalf("copied %d bytes, want %d", n, size)
+	}
+
+	assertWithinTolerance(t, elapsed, steadyStateWant(size, rate, burst))
+}
+
+func TestWriterSteadyStateRateAccuracy(t *testing.T) {
+	const (
+		rate  = 200 * 1000
+		burst = 2000
+		size  = burst + rate/2
+	)
+
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	w.SetRateLimitWithBurst(rate, burst)
+
+	start := time.Now()
+	n, err := io.Copy(w, bytes.NewReader(make([]byte, size)))
+	elapsed := time.Since(start)
+	if err != nil {
+		t.Fatalf("Copy: %v", err)
+	}
+	if n != size {
+		t.Fatalf("wrote %d bytes, want %d", n, size)
+	}
+
+	assertWithinTolerance(t, elapsed, steadyStateWant(size, rate, burst))
+}
+
+func TestConnSmallReadReturnsImmediately(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	go server.Write(make([]byte, 1<<20))
+
+	c := NewConn(client)
+	c.SetReadRateLimit(1 << 20) // 1 MiB/s
+
+	start := time.Now()
+	var p [1]byte
+	if _, err := c.Read(p[:]); err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Millisecond {
+		t.Fatalf("Read(p[:1]) on a fresh 1 MiB/s Conn took %v, want < 10ms", elapsed)
+	}
+}
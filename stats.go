@@ -0,0 +1,130 @@
+package shapeio
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrLimitReached is returned by Read/Write once the cap set with SetCap
+// has been reached.
+var ErrLimitReached = errors.New("shapeio: transfer cap reached")
+
+// statsWindow is how far back CurrentRate looks to compute an instantaneous
+// rate.
+const statsWindow = 5 * time.Second
+
+// statsRingSize bounds the number of samples kept for the instantaneous
+// rate calculation.
+const statsRingSize = 16
+
+// Stats is a point-in-time snapshot of a stream's transfer activity.
+type Stats struct {
+	// BytesTransferred is the total number of bytes read or written so far.
+	BytesTransferred int64
+	// Elapsed is the time since the first byte flowed.
+	Elapsed time.Duration
+	// CurrentRate is the instantaneous rate, in bytes/sec, over the
+	// trailing window.
+	CurrentRate float64
+	// AverageRate is the average rate, in bytes/sec, since the first byte
+	// flowed.
+	AverageRate float64
+}
+
+type statsSample struct {
+	at time.Time
+	n  int64
+}
+
+// flowStats tracks the byte count, optional cap, and rate history of a
+// Reader or Writer. It is safe for concurrent use.
+type flowStats struct {
+	cap         int64 // atomic; 0 means unlimited
+	transferred int64 // atomic
+	startedAt   int64 // atomic, unix nanoseconds; 0 until the first byte
+
+	mu      sync.Mutex
+	ring    [statsRingSize]statsSample
+	ringPos int
+	ringLen int
+}
+
+// setCap sets the maximum number of bytes that may flow before Read/Write
+// start returning ErrLimitReached. A cap of 0 means unlimited.
+func (fs *flowStats) setCap(n int64) {
+	atomic.StoreInt64(&fs.cap, n)
+}
+
+// reserve returns how many of the want bytes may be transferred next,
+// clamped to what remains of the cap, or ErrLimitReached if the cap has
+// already been reached.
+func (fs *flowStats) reserve(want int) (int, error) {
+	capN := atomic.LoadInt64(&fs.cap)
+	if capN <= 0 {
+		return want, nil
+	}
+
+	remaining := capN - atomic.LoadInt64(&fs.transferred)
+	if remaining <= 0 {
+		return 0, ErrLimitReached
+	}
+	if int64(want) > remaining {
+		want = int(remaining)
+	}
+	return want, nil
+}
+
+// add records that n more bytes have been transferred.
+func (fs *flowStats) add(n int) {
+	if n <= 0 {
+		return
+	}
+
+	now := time.Now()
+	atomic.CompareAndSwapInt64(&fs.startedAt, 0, now.UnixNano())
+	total := atomic.AddInt64(&fs.transferred, int64(n))
+
+	fs.mu.Lock()
+	fs.ring[fs.ringPos] = statsSample{at: now, n: total}
+	fs.ringPos = (fs.ringPos + 1) % statsRingSize
+	if fs.ringLen < statsRingSize {
+		fs.ringLen++
+	}
+	fs.mu.Unlock()
+}
+
+// snapshot returns the current Stats.
+func (fs *flowStats) snapshot() Stats {
+	st := Stats{BytesTransferred: atomic.LoadInt64(&fs.transferred)}
+
+	startedAt := atomic.LoadInt64(&fs.startedAt)
+	if startedAt == 0 {
+		return st
+	}
+
+	now := time.Now()
+	st.Elapsed = now.Sub(time.Unix(0, startedAt))
+	if st.Elapsed > 0 {
+		st.AverageRate = float64(st.BytesTransferred) / st.Elapsed.Seconds()
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	oldest, found := statsSample{}, false
+	for i := 0; i < fs.ringLen; i++ {
+		idx := (fs.ringPos - 1 - i + statsRingSize) % statsRingSize
+		if now.Sub(fs.ring[idx].at) > statsWindow {
+			break
+		}
+		oldest, found = fs.ring[idx], true
+	}
+	if found {
+		if dt := now.Sub(oldest.at).Seconds(); dt > 0 {
+			st.CurrentRate = float64(st.BytesTransferred-oldest.n) / dt
+		}
+	}
+	return st
+}